@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tg123/go-htpasswd"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// dummyBcryptHash is compared against on every failed htpasswd match, so
+// that a lookup for an unknown user still costs a bcrypt comparison
+// instead of returning at once. A wrong password for a known user runs
+// its own hash check plus this one, so the two failure cases are not
+// timed identically.
+const dummyBcryptHash = "$2a$10$CwTycUXWue0Thq9StjUM0uJ8q.mR0b5WhR8l.9R0G7H2LkXQ8W0Gm"
+
+// Authenticator is the pluggable backend behind ProxyServer.auth. It
+// replaces the single baked-in UserAuth/ProxyAuth string so a deployment
+// can rotate credentials or serve multiple users without rebuilding the
+// binary.
+type Authenticator interface {
+	Validate(user, pass string) bool
+	Close()
+}
+
+// NewAuthenticator parses a URL-style config string and returns the
+// matching backend:
+//
+//	static://?user=u&pass=p     a single baked-in credential
+//	basicfile:///etc/gofw.htpasswd   htpasswd file, reloaded on change
+//	none://                     auth always succeeds
+func NewAuthenticator(config string) (Authenticator, error) {
+	scheme, rest, ok := strings.Cut(config, "://")
+	if !ok {
+		return nil, fmt.Errorf("invalid auth config: %s", config)
+	}
+
+	switch scheme {
+	case "none":
+		return noneAuth{}, nil
+	case "static":
+		return newStaticAuth(rest)
+	case "basicfile":
+		return newHtpasswdAuth(rest)
+	default:
+		return nil, fmt.Errorf("unknown auth scheme: %s", scheme)
+	}
+}
+
+type noneAuth struct{}
+
+func (noneAuth) Validate(user, pass string) bool { return true }
+func (noneAuth) Close()                          {}
+
+// staticAuth is the single-baked-in-secret backend, kept around so
+// existing UserAuth/ProxyAuth style deployments don't have to stand up a
+// htpasswd file just to keep working.
+type staticAuth struct {
+	user, pass string
+}
+
+func newStaticAuth(query string) (Authenticator, error) {
+	values, err := parseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	return &staticAuth{user: values["user"], pass: values["pass"]}, nil
+}
+
+func (a *staticAuth) Validate(user, pass string) bool {
+	okUser := subtle.ConstantTimeCompare([]byte(user), []byte(a.user)) == 1
+	okPass := subtle.ConstantTimeCompare([]byte(pass), []byte(a.pass)) == 1
+	return okUser && okPass
+}
+
+func (a *staticAuth) Close() {}
+
+// htpasswdAuth backs onto a tg123/go-htpasswd table, reloaded whenever
+// the file's mtime changes (polled every 5 seconds) or HandleSIGHUP is
+// called; it does not register a signal handler itself. Supports
+// bcrypt ($2a$/$2y$), apr1 MD5 crypt ($apr1$) and legacy {SHA} lines.
+type htpasswdAuth struct {
+	path string
+
+	mu   sync.RWMutex
+	file *htpasswd.File
+
+	stopCh chan struct{}
+}
+
+func newHtpasswdAuth(path string) (Authenticator, error) {
+	f, err := htpasswd.New(path, htpasswd.DefaultSystems, nil)
+	if err != nil {
+		return nil, fmt.Errorf("load htpasswd file %s: %v", path, err)
+	}
+
+	a := &htpasswdAuth{path: path, file: f, stopCh: make(chan struct{})}
+	go a.watch()
+	return a, nil
+}
+
+func (a *htpasswdAuth) watch() {
+	var lastMod time.Time
+	if st, err := os.Stat(a.path); err == nil {
+		lastMod = st.ModTime()
+	}
+
+	t := time.NewTicker(5 * time.Second)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			st, err := os.Stat(a.path)
+			if err != nil || !st.ModTime().After(lastMod) {
+				continue
+			}
+			lastMod = st.ModTime()
+			a.reload()
+		case <-a.stopCh:
+			return
+		}
+	}
+}
+
+// reload swaps the *htpasswd.File pointer atomically under the write
+// lock so concurrent Validate calls never observe a half-parsed table.
+func (a *htpasswdAuth) reload() {
+	f, err := htpasswd.New(a.path, htpasswd.DefaultSystems, nil)
+	if err != nil {
+		// keep serving the old table rather than locking everyone out
+		// because of a transient parse error
+		return
+	}
+
+	a.mu.Lock()
+	a.file = f
+	a.mu.Unlock()
+}
+
+// HandleSIGHUP triggers an immediate reload, for callers that wire this
+// authenticator to a signal.Notify(syscall.SIGHUP) channel.
+func (a *htpasswdAuth) HandleSIGHUP() {
+	a.reload()
+}
+
+func (a *htpasswdAuth) Validate(user, pass string) bool {
+	a.mu.RLock()
+	f := a.file
+	a.mu.RUnlock()
+
+	if f == nil || !f.Match(user, pass) {
+		// run a dummy bcrypt compare so "user not found" does not return
+		// faster than a real hash check; a wrong password for a known
+		// user pays for both compares
+		bcrypt.CompareHashAndPassword([]byte(dummyBcryptHash), []byte(pass))
+		return false
+	}
+
+	return true
+}
+
+func (a *htpasswdAuth) Close() {
+	close(a.stopCh)
+}
+
+func parseQuery(query string) (map[string]string, error) {
+	values := map[string]string{}
+	query = strings.TrimPrefix(query, "?")
+	if query == "" {
+		return values, nil
+	}
+
+	for _, pair := range strings.Split(query, "&") {
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid query fragment: %s", pair)
+		}
+		values[k] = v
+	}
+
+	return values, nil
+}
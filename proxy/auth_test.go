@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewAuthenticatorNone(t *testing.T) {
+	a, err := NewAuthenticator("none://")
+	if err != nil {
+		t.Fatalf("NewAuthenticator: %v", err)
+	}
+	defer a.Close()
+
+	if !a.Validate("anyone", "anything") {
+		t.Fatalf("none:// backend should accept any credential")
+	}
+}
+
+func TestNewAuthenticatorStatic(t *testing.T) {
+	a, err := NewAuthenticator("static://?user=alice&pass=s3cret")
+	if err != nil {
+		t.Fatalf("NewAuthenticator: %v", err)
+	}
+	defer a.Close()
+
+	if !a.Validate("alice", "s3cret") {
+		t.Fatalf("expected correct credential to validate")
+	}
+	if a.Validate("alice", "wrong") {
+		t.Fatalf("expected wrong password to fail")
+	}
+	if a.Validate("mallory", "s3cret") {
+		t.Fatalf("expected unknown user to fail")
+	}
+}
+
+func TestNewAuthenticatorUnknownScheme(t *testing.T) {
+	if _, err := NewAuthenticator("ldap://whatever"); err == nil {
+		t.Fatalf("expected an error for an unsupported scheme")
+	}
+}
+
+func TestHtpasswdAuthBcrypt(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "htpasswd")
+
+	// bob / hunter2, bcrypt cost 4 (cheap, test-only)
+	const line = "bob:$2a$04$CM2Yagi5AFEjGjHVnjvYW.wcZpp764zmlibmU/z1dLOktcyhwpSZa"
+	if err := os.WriteFile(path, []byte(line+"\n"), 0o600); err != nil {
+		t.Fatalf("write htpasswd file: %v", err)
+	}
+
+	a, err := NewAuthenticator("basicfile://" + path)
+	if err != nil {
+		t.Fatalf("NewAuthenticator: %v", err)
+	}
+	defer a.Close()
+
+	if !a.Validate("bob", "hunter2") {
+		t.Fatalf("expected correct bcrypt password to validate")
+	}
+	if a.Validate("bob", "definitely-not-hunter2") {
+		t.Fatalf("expected wrong password to fail")
+	}
+	if a.Validate("carol", "hunter2") {
+		t.Fatalf("expected unknown user to fail")
+	}
+}
+
+func TestHtpasswdAuthReloadsOnChange(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "htpasswd")
+
+	if err := os.WriteFile(path, []byte("dave:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"), 0o600); err != nil {
+		t.Fatalf("write htpasswd file: %v", err)
+	}
+
+	a, err := newHtpasswdAuth(path)
+	if err != nil {
+		t.Fatalf("newHtpasswdAuth: %v", err)
+	}
+	ha := a.(*htpasswdAuth)
+	defer ha.Close()
+
+	if !ha.Validate("dave", "password") {
+		t.Fatalf("expected the initially loaded user to validate")
+	}
+
+	if err := os.WriteFile(path, []byte("eve:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"), 0o600); err != nil {
+		t.Fatalf("rewrite htpasswd file: %v", err)
+	}
+	ha.HandleSIGHUP()
+
+	if ha.Validate("dave", "password") {
+		t.Fatalf("expected dave to be gone after reload")
+	}
+	if !ha.Validate("eve", "password") {
+		t.Fatalf("expected eve to validate after reload")
+	}
+}
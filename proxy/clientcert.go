@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+)
+
+// PolicyClientCert, when set on ProxyServer.Policy, requires the TLS
+// frontend to perform mutual TLS and authenticates connections by peer
+// certificate identity instead of the shared UserAuth/Authenticator
+// password.
+const PolicyClientCert = 1 << 10
+
+// ClientIdentity is what a verified client certificate resolves to:
+// either its Subject CN or a SAN URI, whichever the allowlist was keyed
+// on. It's recorded on the clientRequest for logging and per-user rate
+// limiting.
+type ClientIdentity string
+
+// clientCertTLSConfig builds the tls.Config the KCP/HTTPS frontend
+// should use when PolicyClientCert is set: client certs are required and
+// verified against proxy.ClientCAPool.
+func (proxy *ProxyServer) clientCertTLSConfig(base *tls.Config) *tls.Config {
+	cfg := base.Clone()
+	cfg.ClientCAs = proxy.ClientCAPool
+	cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	return cfg
+}
+
+// identifyClientCert resolves the verified peer certificate in state to
+// a ClientIdentity allowed by proxy.ClientCertAllow, checking the
+// Subject CN first and then any SAN URIs. Returns ok=false if the peer
+// presented no certificate or its identity isn't on the allowlist.
+func (proxy *ProxyServer) identifyClientCert(state *tls.ConnectionState) (ClientIdentity, bool) {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return "", false
+	}
+
+	cert := state.PeerCertificates[0]
+
+	if id := ClientIdentity(cert.Subject.CommonName); proxy.ClientCertAllow[id] {
+		return id, true
+	}
+
+	for _, uri := range cert.URIs {
+		if id := ClientIdentity(uri.String()); proxy.ClientCertAllow[id] {
+			return id, true
+		}
+	}
+
+	return "", false
+}
+
+// authConn is the per-connection authentication check. Without
+// PolicyClientCert it is proxy.auth on userpass; with PolicyClientCert
+// the verified client certificate alone decides and userpass is not
+// checked.
+func (proxy *ProxyServer) authConn(state *tls.ConnectionState, userpass string) (ClientIdentity, bool) {
+	if !proxy.Policy.IsSet(PolicyClientCert) {
+		return "", proxy.auth(userpass)
+	}
+
+	id, ok := proxy.identifyClientCert(state)
+	if !ok {
+		return "", false
+	}
+
+	return id, true
+}
+
+// clientTLSConfig builds the tls.Config used when dialing the upstream
+// over TLS/KCP-TLS, presenting proxy.ClientCert when the server expects
+// mTLS. Safe to call with a zero-value ClientCert: an empty
+// tls.Certificate list is simply not presented, same as today.
+func (proxy *ProxyClient) clientTLSConfig(base *tls.Config) *tls.Config {
+	cfg := base.Clone()
+	if proxy.ClientCert.Certificate != nil {
+		cfg.Certificates = []tls.Certificate{proxy.ClientCert}
+	}
+	return cfg
+}
+
+// loadClientCAPool reads one or more PEM-encoded CA certificate files
+// into a pool suitable for ProxyServer.ClientCAPool.
+func loadClientCAPool(pemData ...[]byte) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	for i, data := range pemData {
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("client CA bundle #%d: no certificates found", i)
+		}
+	}
+	return pool, nil
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/url"
+	"testing"
+)
+
+func stateWithCN(cn string) *tls.ConnectionState {
+	return &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{
+			{Subject: pkix.Name{CommonName: cn}},
+		},
+	}
+}
+
+func stateWithSAN(uri string) *tls.ConnectionState {
+	u, _ := url.Parse(uri)
+	return &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{
+			{URIs: []*url.URL{u}},
+		},
+	}
+}
+
+func TestIdentifyClientCertByCN(t *testing.T) {
+	proxy := &ProxyServer{ClientCertAllow: map[ClientIdentity]bool{"alice": true}}
+
+	id, ok := proxy.identifyClientCert(stateWithCN("alice"))
+	if !ok || id != "alice" {
+		t.Errorf("expected alice's CN to be allowed, got id=%q ok=%v", id, ok)
+	}
+
+	if _, ok := proxy.identifyClientCert(stateWithCN("mallory")); ok {
+		t.Error("expected a CN not on the allowlist to be rejected")
+	}
+}
+
+func TestIdentifyClientCertBySAN(t *testing.T) {
+	proxy := &ProxyServer{ClientCertAllow: map[ClientIdentity]bool{"spiffe://example/bob": true}}
+
+	id, ok := proxy.identifyClientCert(stateWithSAN("spiffe://example/bob"))
+	if !ok || id != "spiffe://example/bob" {
+		t.Errorf("expected bob's SAN URI to be allowed, got id=%q ok=%v", id, ok)
+	}
+}
+
+func TestIdentifyClientCertNoCertificate(t *testing.T) {
+	proxy := &ProxyServer{ClientCertAllow: map[ClientIdentity]bool{"alice": true}}
+
+	if _, ok := proxy.identifyClientCert(nil); ok {
+		t.Error("expected a nil ConnectionState to be rejected")
+	}
+	if _, ok := proxy.identifyClientCert(&tls.ConnectionState{}); ok {
+		t.Error("expected a ConnectionState with no peer certificates to be rejected")
+	}
+}
+
+func TestAuthConnFallsBackToPasswordWhenPolicyUnset(t *testing.T) {
+	proxy := &ProxyServer{UserAuth: "user:pass"}
+
+	if _, ok := proxy.authConn(nil, "user:pass"); !ok {
+		t.Error("expected authConn to fall back to the password check when PolicyClientCert is unset")
+	}
+	if _, ok := proxy.authConn(nil, "user:wrong"); ok {
+		t.Error("expected a wrong password to fail the fallback check")
+	}
+}
+
+func TestAuthConnRequiresCertWhenPolicySet(t *testing.T) {
+	proxy := &ProxyServer{
+		Policy:          Options(PolicyClientCert),
+		ClientCertAllow: map[ClientIdentity]bool{"alice": true},
+		UserAuth:        "user:pass",
+	}
+
+	// a correct password is not enough once PolicyClientCert is set - the
+	// cert check must run instead of (not merely alongside) a no-cert conn.
+	if _, ok := proxy.authConn(nil, "user:pass"); ok {
+		t.Error("expected authConn to reject a connection with no client cert even with a valid password")
+	}
+
+	id, ok := proxy.authConn(stateWithCN("alice"), "user:pass")
+	if !ok || id != "alice" {
+		t.Errorf("expected a valid client cert to authenticate, got id=%q ok=%v", id, ok)
+	}
+}
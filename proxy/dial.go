@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// dialUpstream is the single chokepoint the CONNECT, WebSocket and KCP
+// dial paths should all go through to reach a bridge server: it picks an
+// address (via the UpstreamPool when one is configured, falling back to
+// the fixed Upstream otherwise) and reports the real dial outcome back
+// into the pool, so health state reflects actual traffic instead of only
+// the background prober.
+func (proxy *ProxyClient) dialUpstream() (net.Conn, error) {
+	addr := proxy.upstream()
+	start := time.Now()
+
+	dialer := net.Dialer{Timeout: timeoutDial}
+
+	var conn net.Conn
+	var err error
+	if proxy.Policy.IsSet(PolicyHTTPS) || proxy.Policy.IsSet(PolicyKCP) {
+		conn, err = tls.DialWithDialer(&dialer, "tcp", addr, proxy.clientTLSConfig(tlsSkip))
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+
+	if proxy.Pool != nil {
+		proxy.Pool.MarkResult(addr, err, time.Since(start))
+	}
+
+	return conn, err
+}
+
+// Dial is the entry point CONNECT handling, the WebSocket upgrade path
+// and the KCP dial path should all call instead of reaching for
+// encryptRequest/dialUpstream directly: it consults the Dispatcher first
+// so ActionReject/ActionDirect rules actually take effect (previously
+// Dispatch's Action was resolved but discarded, so neither rule type did
+// anything), then either rejects, dials the real destination directly,
+// or opens the tunnel connection and builds the encrypted request.
+func (proxy *ProxyClient) Dial(req *http.Request, r *clientRequest) (net.Conn, [ivLen]byte, error) {
+	decision := proxy.dispatchDecision(req)
+
+	switch decision.Action {
+	case ActionReject:
+		return nil, [ivLen]byte{}, fmt.Errorf("proxy: %s rejected by dispatch rule", req.Host)
+
+	case ActionDirect:
+		// reqHostPort applies the same implicit-port defaulting used for
+		// rule matching (80/443); req.URL.Host alone is just "example.com"
+		// for a plain proxied request and fails net.Dial with "missing
+		// port in address".
+		host, port := reqHostPort(req)
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), timeoutDial)
+		return conn, [ivLen]byte{}, err
+
+	default:
+		conn, err := proxy.dialUpstream()
+		if err != nil {
+			return nil, [ivLen]byte{}, err
+		}
+
+		iv := proxy.encryptRequest(req, r, decision)
+		return conn, iv, nil
+	}
+}
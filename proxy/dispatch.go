@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Action is what a matched Rule tells the dispatcher to do with a
+// connection/request.
+type Action int
+
+const (
+	ActionDirect Action = iota
+	ActionProxy
+	ActionReject
+	ActionMITM
+	ActionSetPolicy
+	ActionRewriteHost
+)
+
+// Rule is one entry in a Dispatcher's ordered rule list: a predicate over
+// the outgoing request plus the Action to take when it matches. Modeled
+// on goproxy's OnRequest(ReqHostMatches(...)) chain, but evaluated
+// up front per-connection instead of per goproxy-style middleware hook.
+type Rule struct {
+	HostPattern *regexp.Regexp // matches req.Host / SNI
+	CIDR        *net.IPNet     // matches the resolved IP, nil to skip
+	PortMin     int            // 0 means "any"
+	PortMax     int
+	Method      string // "" means "any"
+
+	// Country restricts the match to hosts whose resolved IP is in this
+	// ISO country code, via the Dispatcher's configured GeoIP backend.
+	// "" means "any country" (no GeoIP lookup performed).
+	Country string
+
+	Action Action
+
+	// SetPolicy is used when Action == ActionSetPolicy.
+	SetPolicy Options
+	// RewriteTo is used when Action == ActionRewriteHost: the new
+	// "host:port" to dial instead of the matched one.
+	RewriteTo string
+}
+
+// matches reports whether r applies to the given host, resolved IP,
+// port and method. An empty/nil predicate field always matches.
+func (r *Rule) matches(host string, ip net.IP, port int, method string) bool {
+	if r.HostPattern != nil && !r.HostPattern.MatchString(host) {
+		return false
+	}
+
+	if r.CIDR != nil && (ip == nil || !r.CIDR.Contains(ip)) {
+		return false
+	}
+
+	if r.PortMin > 0 && (port < r.PortMin || port > r.PortMax) {
+		return false
+	}
+
+	if r.Method != "" && !strings.EqualFold(r.Method, method) {
+		return false
+	}
+
+	return true
+}
+
+// Decision is what the Dispatcher resolved for one connection attempt.
+type Decision struct {
+	Action    Action
+	Policy    Options
+	RewriteTo string
+}
+
+// Dispatcher holds an ordered list of Rules plus an optional GeoIP
+// lookup, consulted by ProxyClient.Dial (via dispatchDecision), which
+// hands the Decision on to encryptRequest, instead of the single global
+// proxy.Policy and the hardcoded chinalist. The first matching rule wins.
+type Dispatcher struct {
+	mu    sync.RWMutex
+	rules []*Rule
+	geoIP GeoIPLookup
+}
+
+// GeoIPLookup resolves an IP to an ISO country code, backed by an MMDB
+// file in the default implementation (see NewMMDBGeoIP).
+type GeoIPLookup interface {
+	Country(ip net.IP) (string, error)
+}
+
+// NewDispatcher builds a Dispatcher from an ordered rule list. Rules are
+// evaluated in slice order; put the most specific ones first.
+func NewDispatcher(rules []*Rule) *Dispatcher {
+	return &Dispatcher{rules: rules}
+}
+
+// SetGeoIP attaches a GeoIP backend used by Rules with Country set,
+// which Dispatch checks via CountryIs (geoip.go).
+func (d *Dispatcher) SetGeoIP(g GeoIPLookup) {
+	d.geoIP = g
+}
+
+// setRules atomically swaps in a freshly parsed rule list, used by the
+// rule-file reloader so an in-flight Dispatch never sees a half-updated
+// slice.
+func (d *Dispatcher) setRules(rules []*Rule) {
+	d.mu.Lock()
+	d.rules = rules
+	d.mu.Unlock()
+}
+
+// Dispatch resolves the Decision for one outgoing request/CONNECT,
+// falling back to ActionProxy (tunnel it through upstream, same as
+// today's default behavior) when nothing matches. Action == ActionProxy
+// in the returned Decision always means "go ahead and tunnel it through
+// encryptRequest" - Policy/RewriteTo (additive: callers should OR Policy
+// into their base policy, not replace it) carry the rest of what
+// ActionSetPolicy/ActionRewriteHost/ActionMITM asked for. Callers must
+// check Action == ActionReject / ActionDirect themselves before ever
+// calling encryptRequest, since those two skip the tunnel entirely.
+func (d *Dispatcher) Dispatch(host string, ip net.IP, port int, method string) Decision {
+	d.mu.RLock()
+	rules := d.rules
+	d.mu.RUnlock()
+
+	for _, r := range rules {
+		if !r.matches(host, ip, port, method) {
+			continue
+		}
+
+		if r.Country != "" && !d.CountryIs(ip, r.Country) {
+			continue
+		}
+
+		switch r.Action {
+		case ActionSetPolicy:
+			return Decision{Action: ActionProxy, Policy: r.SetPolicy}
+		case ActionRewriteHost:
+			return Decision{Action: ActionProxy, RewriteTo: r.RewriteTo}
+		case ActionMITM:
+			return Decision{Action: ActionProxy, Policy: Options(PolicyMITM)}
+		default:
+			return Decision{Action: r.Action}
+		}
+	}
+
+	return Decision{Action: ActionProxy}
+}
+
+// splitHostPortInt is splitHostPort plus a numeric port, used by callers
+// that need PortMin/PortMax matching against a "host:port" address.
+func splitHostPortInt(addr string) (host string, port int) {
+	h, p := splitHostPort(addr)
+	p = strings.TrimPrefix(p, ":")
+	n, _ := strconv.Atoi(p)
+	return h, n
+}
+
+// reqHostPort extracts the dispatch-relevant host and port from an
+// *http.Request, covering both CONNECT (req.Host) and proxied plain HTTP
+// requests (req.URL.Host), defaulting the port from the scheme/method
+// when the address doesn't carry one explicitly.
+func reqHostPort(req *http.Request) (host string, port int) {
+	addr := req.URL.Host
+	if req.Method == http.MethodConnect {
+		addr = req.Host
+	}
+
+	host, port = splitHostPortInt(addr)
+	if port == 0 {
+		if req.Method == http.MethodConnect || req.URL.Scheme == "https" {
+			port = 443
+		} else {
+			port = 80
+		}
+	}
+
+	return host, port
+}
+
+// dispatchDecision resolves the Dispatcher's Decision for req, looking
+// up the host's IP so Rule.CIDR/Country predicates can actually match
+// (a nil IP makes both always fail). Returns the default
+// Decision{Action: ActionProxy} unchanged when no Dispatcher is
+// configured, so this is always safe to call.
+func (proxy *ProxyClient) dispatchDecision(req *http.Request) Decision {
+	if proxy.Dispatcher == nil {
+		return Decision{Action: ActionProxy}
+	}
+
+	host, port := reqHostPort(req)
+
+	var ip net.IP
+	if addrs, err := net.LookupIP(host); err == nil && len(addrs) > 0 {
+		ip = addrs[0]
+	}
+
+	return proxy.Dispatcher.Dispatch(host, ip, port, req.Method)
+}
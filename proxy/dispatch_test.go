@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"net"
+	"regexp"
+	"testing"
+)
+
+func TestRuleMatches(t *testing.T) {
+	r := &Rule{
+		HostPattern: mustCompile(t, `\.cn$`),
+		PortMin:     80,
+		PortMax:     443,
+		Method:      "GET",
+	}
+
+	if !r.matches("example.cn", nil, 443, "get") {
+		t.Error("expected host/port/method (case-insensitive) to match")
+	}
+	if r.matches("example.com", nil, 443, "GET") {
+		t.Error("host pattern should reject a non-matching TLD")
+	}
+	if r.matches("example.cn", nil, 8080, "GET") {
+		t.Error("port outside PortMin/PortMax should not match")
+	}
+	if r.matches("example.cn", nil, 443, "POST") {
+		t.Error("method mismatch should not match")
+	}
+}
+
+func TestRuleMatchesEmptyPredicatesAlwaysMatch(t *testing.T) {
+	r := &Rule{}
+	if !r.matches("anything.example", net.ParseIP("1.2.3.4"), 12345, "PATCH") {
+		t.Error("a Rule with no predicates set should match anything")
+	}
+}
+
+func TestDispatchFirstMatchWins(t *testing.T) {
+	d := NewDispatcher([]*Rule{
+		{HostPattern: mustCompile(t, `^a\.example$`), Action: ActionReject},
+		{HostPattern: mustCompile(t, `\.example$`), Action: ActionDirect},
+	})
+
+	if got := d.Dispatch("a.example", nil, 80, "GET"); got.Action != ActionReject {
+		t.Errorf("expected the first matching rule (reject) to win, got %v", got.Action)
+	}
+	if got := d.Dispatch("b.example", nil, 80, "GET"); got.Action != ActionDirect {
+		t.Errorf("expected the second rule to match b.example, got %v", got.Action)
+	}
+}
+
+func TestDispatchDefaultsToProxy(t *testing.T) {
+	d := NewDispatcher(nil)
+	got := d.Dispatch("anything", nil, 80, "GET")
+	if got.Action != ActionProxy {
+		t.Errorf("expected an empty rule list to default to ActionProxy, got %v", got.Action)
+	}
+}
+
+func TestDispatchFoldsSetPolicyRewriteAndMITMIntoProxy(t *testing.T) {
+	d := NewDispatcher([]*Rule{
+		{HostPattern: mustCompile(t, `^policy\.example$`), Action: ActionSetPolicy, SetPolicy: Options(PolicyHTTPS)},
+		{HostPattern: mustCompile(t, `^rewrite\.example$`), Action: ActionRewriteHost, RewriteTo: "other:8080"},
+		{HostPattern: mustCompile(t, `^mitm\.example$`), Action: ActionMITM},
+	})
+
+	if got := d.Dispatch("policy.example", nil, 80, "GET"); got.Action != ActionProxy || got.Policy != Options(PolicyHTTPS) {
+		t.Errorf("expected ActionSetPolicy to fold into ActionProxy with Policy set, got %+v", got)
+	}
+	if got := d.Dispatch("rewrite.example", nil, 80, "GET"); got.Action != ActionProxy || got.RewriteTo != "other:8080" {
+		t.Errorf("expected ActionRewriteHost to fold into ActionProxy with RewriteTo set, got %+v", got)
+	}
+	if got := d.Dispatch("mitm.example", nil, 80, "GET"); got.Action != ActionProxy || got.Policy != Options(PolicyMITM) {
+		t.Errorf("expected ActionMITM to fold into ActionProxy with PolicyMITM set, got %+v", got)
+	}
+}
+
+// fakeGeoIP is a canned GeoIPLookup used to test Rule.Country gating
+// without touching a real MMDB file.
+type fakeGeoIP map[string]string
+
+func (f fakeGeoIP) Country(ip net.IP) (string, error) {
+	return f[ip.String()], nil
+}
+
+func TestDispatchCountryGating(t *testing.T) {
+	d := NewDispatcher([]*Rule{
+		{Action: ActionReject, Country: "CN"},
+	})
+	d.SetGeoIP(fakeGeoIP{"1.2.3.4": "CN", "5.6.7.8": "US"})
+
+	if got := d.Dispatch("host", net.ParseIP("1.2.3.4"), 80, "GET"); got.Action != ActionReject {
+		t.Errorf("expected a CN IP to match the CN rule, got %v", got.Action)
+	}
+	if got := d.Dispatch("host", net.ParseIP("5.6.7.8"), 80, "GET"); got.Action != ActionProxy {
+		t.Errorf("expected a non-CN IP to fall through to the default, got %v", got.Action)
+	}
+}
+
+func TestDispatchCountryRuleNoBackendNeverMatches(t *testing.T) {
+	d := NewDispatcher([]*Rule{
+		{Action: ActionReject, Country: "CN"},
+	})
+
+	if got := d.Dispatch("host", net.ParseIP("1.2.3.4"), 80, "GET"); got.Action != ActionProxy {
+		t.Errorf("expected a Country rule with no GeoIP backend to be a no-op, got %v", got.Action)
+	}
+}
+
+func TestParseRuleLine(t *testing.T) {
+	r, err := parseRuleLine("host=^foo\\.com$ port=80-443 method=GET country=US action=rewrite to=bar.com:8080")
+	if err != nil {
+		t.Fatalf("parseRuleLine: %v", err)
+	}
+
+	if !r.HostPattern.MatchString("foo.com") {
+		t.Error("expected host pattern to compile and match foo.com")
+	}
+	if r.PortMin != 80 || r.PortMax != 443 {
+		t.Errorf("expected port range 80-443, got %d-%d", r.PortMin, r.PortMax)
+	}
+	if r.Method != "GET" {
+		t.Errorf("expected method GET, got %q", r.Method)
+	}
+	if r.Country != "US" {
+		t.Errorf("expected country US, got %q", r.Country)
+	}
+	if r.Action != ActionRewriteHost || r.RewriteTo != "bar.com:8080" {
+		t.Errorf("expected rewrite to bar.com:8080, got action=%v to=%q", r.Action, r.RewriteTo)
+	}
+}
+
+func TestParseRuleLineUnknownAction(t *testing.T) {
+	if _, err := parseRuleLine("action=teleport"); err == nil {
+		t.Error("expected an unknown action to be rejected")
+	}
+}
+
+func TestParseRuleLineUnknownField(t *testing.T) {
+	if _, err := parseRuleLine("wat=huh"); err == nil {
+		t.Error("expected an unknown field to be rejected")
+	}
+}
+
+func mustCompile(t *testing.T, pattern string) *regexp.Regexp {
+	t.Helper()
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		t.Fatalf("regexp.Compile(%q): %v", pattern, err)
+	}
+	return re
+}
@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// mmdbGeoIP is the built-in GeoIPLookup backed by a MaxMind-format MMDB
+// file (GeoLite2-Country or commercial equivalent).
+type mmdbGeoIP struct {
+	db *maxminddb.Reader
+}
+
+// NewMMDBGeoIP opens an MMDB file for use as a Dispatcher GeoIP backend.
+// maxminddb.Open mmaps the file; the mapping stays open for the life of
+// the returned lookup, which has no Close method.
+func NewMMDBGeoIP(path string) (GeoIPLookup, error) {
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open geoip db %s: %v", path, err)
+	}
+
+	return &mmdbGeoIP{db: db}, nil
+}
+
+func (g *mmdbGeoIP) Country(ip net.IP) (string, error) {
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+
+	if err := g.db.Lookup(ip, &record); err != nil {
+		return "", err
+	}
+
+	return record.Country.ISOCode, nil
+}
+
+// CountryIs reports whether ip resolves to the given ISO country code
+// under the dispatcher's configured GeoIP backend. Returns false (no
+// match) when no backend is set, so adding a Rule with Country without
+// calling SetGeoIP is a silent no-op rather than a panic.
+func (d *Dispatcher) CountryIs(ip net.IP, code string) bool {
+	if d.geoIP == nil {
+		return false
+	}
+
+	c, err := d.geoIP.Country(ip)
+	return err == nil && strings.EqualFold(c, code)
+}
+
+// ruleFileReloader watches a rule file's mtime and reparses+swaps the
+// Dispatcher's rule list whenever it changes, so rules can be edited and
+// picked up without restarting the process.
+type ruleFileReloader struct {
+	path   string
+	d      *Dispatcher
+	stopCh chan struct{}
+}
+
+// WatchRuleFile starts reloading d's rules from path every interval, as
+// soon as the file's mtime advances. Call the returned stop func to end
+// the watch.
+func WatchRuleFile(d *Dispatcher, path string, interval time.Duration) (stop func(), err error) {
+	rules, err := parseRuleFile(path)
+	if err != nil {
+		return nil, err
+	}
+	d.setRules(rules)
+
+	r := &ruleFileReloader{path: path, d: d, stopCh: make(chan struct{})}
+	go r.watch(interval)
+
+	return func() { close(r.stopCh) }, nil
+}
+
+func (r *ruleFileReloader) watch(interval time.Duration) {
+	var lastMod time.Time
+	if st, err := os.Stat(r.path); err == nil {
+		lastMod = st.ModTime()
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			st, err := os.Stat(r.path)
+			if err != nil || !st.ModTime().After(lastMod) {
+				continue
+			}
+			lastMod = st.ModTime()
+
+			if rules, err := parseRuleFile(r.path); err == nil {
+				r.d.setRules(rules)
+			}
+		case <-r.stopCh:
+			return
+		}
+	}
+}
+
+// parseRuleFile reads a simple one-rule-per-line config:
+//
+//	host=<regexp> [port=min-max] [method=GET] action=direct|proxy|reject|mitm|rewrite [to=host:port]
+//
+// Blank lines and lines starting with '#' are ignored.
+func parseRuleFile(path string) ([]*Rule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer tryClose(f)
+
+	var rules []*Rule
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule, err := parseRuleLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, sc.Err()
+}
+
+func parseRuleLine(line string) (*Rule, error) {
+	r := &Rule{}
+
+	for _, field := range strings.Fields(line) {
+		k, v, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid rule field: %s", field)
+		}
+
+		switch k {
+		case "host":
+			re, err := regexp.Compile(v)
+			if err != nil {
+				return nil, err
+			}
+			r.HostPattern = re
+		case "method":
+			r.Method = v
+		case "country":
+			r.Country = v
+		case "port":
+			lo, hi, _ := strings.Cut(v, "-")
+			r.PortMin, _ = strconv.Atoi(lo)
+			if hi == "" {
+				r.PortMax = r.PortMin
+			} else {
+				r.PortMax, _ = strconv.Atoi(hi)
+			}
+		case "action":
+			switch v {
+			case "direct":
+				r.Action = ActionDirect
+			case "proxy":
+				r.Action = ActionProxy
+			case "reject":
+				r.Action = ActionReject
+			case "mitm":
+				r.Action = ActionMITM
+			case "rewrite":
+				r.Action = ActionRewriteHost
+			default:
+				return nil, fmt.Errorf("unknown action: %s", v)
+			}
+		case "to":
+			r.RewriteTo = v
+		default:
+			return nil, fmt.Errorf("unknown rule field: %s", k)
+		}
+	}
+
+	return r, nil
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestIsWebsocketUpgrade(t *testing.T) {
+	cases := []struct {
+		conn string
+		want bool
+	}{
+		{"Upgrade", true},
+		{"keep-alive, Upgrade", true},
+		{"Upgrade, keep-alive", true},
+		{" upgrade ", true},
+		{"keep-alive", false},
+		{"", false},
+	}
+
+	for _, c := range cases {
+		if got := isWebsocketUpgrade(c.conn); got != c.want {
+			t.Errorf("isWebsocketUpgrade(%q) = %v, want %v", c.conn, got, c.want)
+		}
+	}
+}
+
+func TestSanitizeHopByHopStripsStandardSet(t *testing.T) {
+	h := http.Header{}
+	h.Set("Connection", "Keep-Alive")
+	h.Set("Keep-Alive", "timeout=5")
+	h.Set("Proxy-Authorization", "Basic xxx")
+	h.Set("TE", "trailers")
+	h.Set("Trailer", "X-Foo")
+	h.Set("Transfer-Encoding", "chunked")
+	h.Set("Upgrade", "h2c")
+	h.Set("Content-Type", "text/plain")
+
+	sanitizeHopByHop(h, h.Get("Connection"), nil)
+
+	for _, name := range hopByHopHeaders {
+		if h.Get(name) != "" {
+			t.Errorf("expected %s to be stripped, got %q", name, h.Get(name))
+		}
+	}
+	if h.Get("Content-Type") != "text/plain" {
+		t.Errorf("expected non-hop-by-hop header to survive, got %q", h.Get("Content-Type"))
+	}
+}
+
+func TestSanitizeHopByHopKeepsConnectionOnWebsocketUpgrade(t *testing.T) {
+	h := http.Header{}
+	h.Set("Connection", "Upgrade")
+	h.Set("Upgrade", "websocket")
+	h.Set("Keep-Alive", "timeout=5")
+
+	sanitizeHopByHop(h, h.Get("Connection"), nil)
+
+	if h.Get("Connection") != "Upgrade" {
+		t.Errorf("expected Connection to survive a websocket upgrade, got %q", h.Get("Connection"))
+	}
+	if h.Get("Upgrade") != "websocket" {
+		t.Errorf("expected Upgrade to survive a websocket upgrade, got %q", h.Get("Upgrade"))
+	}
+	if h.Get("Keep-Alive") != "" {
+		t.Errorf("expected Keep-Alive to still be stripped, got %q", h.Get("Keep-Alive"))
+	}
+}
+
+func TestSanitizeHopByHopStripsConnectionNamedHeaders(t *testing.T) {
+	h := http.Header{}
+	h.Set("Connection", "X-Internal-Token")
+	h.Set("X-Internal-Token", "secret")
+	h.Set("X-Public", "keep-me")
+
+	sanitizeHopByHop(h, h.Get("Connection"), nil)
+
+	if h.Get("X-Internal-Token") != "" {
+		t.Errorf("expected header named in Connection field to be stripped")
+	}
+	if h.Get("X-Public") != "keep-me" {
+		t.Errorf("expected unrelated header to survive")
+	}
+}
+
+func TestSanitizeHopByHopAppliesExtraFilter(t *testing.T) {
+	h := http.Header{}
+	h.Set("X-Backend-Secret", "shh")
+	h.Set("X-Public", "keep-me")
+
+	sanitizeHopByHop(h, "", []string{"X-Backend-Secret"})
+
+	if h.Get("X-Backend-Secret") != "" {
+		t.Errorf("expected extraFilter header to be stripped")
+	}
+	if h.Get("X-Public") != "keep-me" {
+		t.Errorf("expected unrelated header to survive")
+	}
+}
@@ -0,0 +1,231 @@
+package proxy
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// failThreshold is the number of consecutive probe/dial failures after
+// which an upstream is considered dead and dropped out of rotation until
+// it recovers.
+const (
+	failThreshold      = 3
+	probeTimeout       = 5 * time.Second
+	defaultProbeEvery  = 30 * time.Second
+	ewmaSmoothingAlpha = 0.2
+)
+
+// upstreamNode tracks per-endpoint health used by UpstreamPool.Pick to
+// decide who gets the next request.
+type upstreamNode struct {
+	addr string
+
+	mu          sync.Mutex
+	failures    int32
+	lastOK      time.Time
+	ewmaLatency time.Duration
+	dead        bool
+
+	// current is the smooth-weighted-round-robin accumulator; only
+	// ever touched by UpstreamPool.Pick, which serializes access via
+	// UpstreamPool.pickMu, so it doesn't need its own lock.
+	current float64
+}
+
+func (n *upstreamNode) recordOK(latency time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.failures = 0
+	n.dead = false
+	n.lastOK = time.Now()
+	if n.ewmaLatency == 0 {
+		n.ewmaLatency = latency
+	} else {
+		n.ewmaLatency = time.Duration(float64(n.ewmaLatency)*(1-ewmaSmoothingAlpha) + float64(latency)*ewmaSmoothingAlpha)
+	}
+}
+
+func (n *upstreamNode) recordFail() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.failures++
+	if n.failures >= failThreshold {
+		n.dead = true
+	}
+}
+
+// weight decays with consecutive failures so a flaky endpoint gets picked
+// less and less often instead of being dropped outright on its first hiccup.
+func (n *upstreamNode) weight() float64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.dead {
+		return 0
+	}
+
+	w := 1.0
+	for i := int32(0); i < n.failures; i++ {
+		w *= 0.5
+	}
+	return w
+}
+
+// UpstreamPool fronts several goflyway bridge servers and picks one per
+// outgoing clientRequest, so a client can point at a single pool instead
+// of a single fixed ProxyClient.Upstream. nodes is fixed for the
+// lifetime of the pool (built once in NewUpstreamPool and never
+// resized), so Pick/MarkResult/probeAll can all range over it without a
+// lock; only the per-node and per-pick mutable state needs guarding.
+type UpstreamPool struct {
+	nodes  []*upstreamNode
+	pickMu sync.Mutex // serializes Pick's smooth-weighted-round-robin state
+	next   uint32     // atomic cursor for the all-dead fallback path
+
+	probeEvery time.Duration
+	stopCh     chan struct{}
+}
+
+// NewUpstreamPool builds a pool from a list of "host:port" upstream
+// endpoints and starts the background health-check loop. Callers own the
+// returned pool and must call Close when done with it.
+func NewUpstreamPool(endpoints []string, probeEvery time.Duration) *UpstreamPool {
+	if probeEvery <= 0 {
+		probeEvery = defaultProbeEvery
+	}
+
+	p := &UpstreamPool{
+		probeEvery: probeEvery,
+		stopCh:     make(chan struct{}),
+	}
+
+	for _, e := range endpoints {
+		p.nodes = append(p.nodes, &upstreamNode{addr: e, lastOK: time.Now()})
+	}
+
+	go p.healthLoop()
+	return p
+}
+
+// Pick returns the next upstream to use, via the same smooth weighted
+// round-robin algorithm nginx uses for upstream balancing: each node's
+// current accumulator advances by its own weight every pick, and the
+// node with the highest accumulator wins and is docked the total weight
+// of all candidates. This makes a flaky node (weight 0.25 after two
+// failures) actually get picked proportionally less often, instead of
+// only mattering once it crosses a hard dead/alive threshold. Falls back
+// to plain round-robin over every node, dead or not, if all of them have
+// decayed to zero weight - a dead pool is still better than refusing to
+// dial at all.
+func (p *UpstreamPool) Pick() string {
+	if len(p.nodes) == 0 {
+		return ""
+	}
+
+	p.pickMu.Lock()
+	defer p.pickMu.Unlock()
+
+	var best *upstreamNode
+	total := 0.0
+
+	for _, n := range p.nodes {
+		w := n.weight()
+		if w <= 0 {
+			continue
+		}
+
+		n.current += w
+		total += w
+		if best == nil || n.current > best.current {
+			best = n
+		}
+	}
+
+	if best == nil {
+		idx := atomic.AddUint32(&p.next, 1)
+		return p.nodes[int(idx)%len(p.nodes)].addr
+	}
+
+	best.current -= total
+	return best.addr
+}
+
+// MarkResult lets callers (the CONNECT/WebSocket/KCP dial paths) report
+// back how a pick went, feeding the EWMA latency and failure decay.
+func (p *UpstreamPool) MarkResult(addr string, err error, latency time.Duration) {
+	for _, n := range p.nodes {
+		if n.addr != addr {
+			continue
+		}
+		if err != nil {
+			n.recordFail()
+		} else {
+			n.recordOK(latency)
+		}
+		return
+	}
+}
+
+func (p *UpstreamPool) healthLoop() {
+	t := time.NewTicker(p.probeEvery)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			p.probeAll()
+		case <-p.stopCh:
+			return
+		}
+	}
+}
+
+func (p *UpstreamPool) probeAll() {
+	for _, n := range p.nodes {
+		go func(n *upstreamNode) {
+			start := time.Now()
+			if err := probeUpstream(n.addr); err != nil {
+				n.recordFail()
+			} else {
+				n.recordOK(time.Since(start))
+			}
+		}(n)
+	}
+}
+
+// Close stops the background health-check loop. Safe to call once.
+func (p *UpstreamPool) Close() {
+	close(p.stopCh)
+}
+
+// probeClient is reused across probes instead of building a fresh
+// *http.Client (and its Transport/connection pool) on every tick.
+var probeClient = &http.Client{Timeout: probeTimeout}
+
+// probeUpstream is the cheap liveness check run by the health loop. A
+// bare TCP dial would happily mark a completely unrelated listener
+// (or a half-open firewall state) as a healthy goflyway bridge, so
+// instead we speak just enough HTTP to know something is actually
+// answering requests on the other end: a HEAD to "/" with the
+// connection closed immediately after. Any response at all - even a
+// 404, since goflyway's handler never knows the request is a probe -
+// counts as alive; any request error (dial, timeout, or a reply that
+// isn't HTTP) marks the node down.
+func probeUpstream(addr string) error {
+	req, err := http.NewRequest(http.MethodHead, "http://"+addr+"/", nil)
+	if err != nil {
+		return err
+	}
+	req.Close = true
+
+	resp, err := probeClient.Do(req)
+	if err != nil {
+		return err
+	}
+	tryClose(resp.Body)
+	return nil
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUpstreamPoolPickRoundRobinsEvenly(t *testing.T) {
+	p := &UpstreamPool{nodes: []*upstreamNode{
+		{addr: "a"}, {addr: "b"}, {addr: "c"},
+	}}
+
+	counts := map[string]int{}
+	for i := 0; i < 300; i++ {
+		counts[p.Pick()]++
+	}
+
+	for _, addr := range []string{"a", "b", "c"} {
+		if counts[addr] != 100 {
+			t.Errorf("expected %s to be picked 100 times, got %d", addr, counts[addr])
+		}
+	}
+}
+
+func TestUpstreamPoolPickBiasesAwayFromFailingNode(t *testing.T) {
+	a := &upstreamNode{addr: "a"}
+	b := &upstreamNode{addr: "b"}
+	p := &UpstreamPool{nodes: []*upstreamNode{a, b}}
+
+	// two failures decays a's weight to 0.25 without marking it dead
+	a.recordFail()
+	a.recordFail()
+
+	counts := map[string]int{}
+	for i := 0; i < 500; i++ {
+		counts[p.Pick()]++
+	}
+
+	if counts["a"] == 0 || counts["a"] >= counts["b"] {
+		t.Fatalf("expected a flaky node to be picked less often than a healthy one, got a=%d b=%d", counts["a"], counts["b"])
+	}
+}
+
+func TestUpstreamPoolPickSkipsDeadNodes(t *testing.T) {
+	a := &upstreamNode{addr: "a"}
+	b := &upstreamNode{addr: "b"}
+	p := &UpstreamPool{nodes: []*upstreamNode{a, b}}
+
+	for i := 0; i < failThreshold; i++ {
+		a.recordFail()
+	}
+
+	for i := 0; i < 50; i++ {
+		if p.Pick() != "b" {
+			t.Fatalf("expected every pick to land on the only live node")
+		}
+	}
+}
+
+func TestUpstreamPoolPickFallsBackWhenAllDead(t *testing.T) {
+	a := &upstreamNode{addr: "a"}
+	b := &upstreamNode{addr: "b"}
+	p := &UpstreamPool{nodes: []*upstreamNode{a, b}}
+
+	for i := 0; i < failThreshold; i++ {
+		a.recordFail()
+		b.recordFail()
+	}
+
+	seen := map[string]bool{}
+	for i := 0; i < 10; i++ {
+		seen[p.Pick()] = true
+	}
+	if !seen["a"] || !seen["b"] {
+		t.Fatalf("expected the dead-pool fallback to still rotate over every node, got %v", seen)
+	}
+}
+
+// TestUpstreamPoolPickMarkResultNoRace exercises Pick concurrently with
+// MarkResult the way the real dial path does (pick, dial, report), and
+// is meant to be run with -race: a prior version of Pick mutated the
+// nodes slice header under pickMu alone while MarkResult/probeAll
+// ranged over it without any lock at all.
+func TestUpstreamPoolPickMarkResultNoRace(t *testing.T) {
+	p := NewUpstreamPool([]string{"a", "b", "c"}, time.Hour)
+	defer p.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				addr := p.Pick()
+				p.MarkResult(addr, nil, time.Millisecond)
+			}
+		}()
+	}
+	wg.Wait()
+}
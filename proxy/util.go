@@ -7,6 +7,7 @@ import (
 
 	"github.com/coyove/goflyway/pkg/msg64"
 
+	"crypto/subtle"
 	"crypto/tls"
 	"encoding/base64"
 	"io"
@@ -148,23 +149,57 @@ func (proxy *ProxyClient) genHost() string {
 	return proxy.DummyDomain
 }
 
-func (proxy *ProxyClient) encryptRequest(req *http.Request, r *clientRequest) [ivLen]byte {
+// upstream returns the bridge server this request should be sent to,
+// consulting the UpstreamPool when one is configured instead of the
+// single fixed Upstream string.
+func (proxy *ProxyClient) upstream() string {
+	if proxy.Pool != nil {
+		if addr := proxy.Pool.Pick(); addr != "" {
+			return addr
+		}
+	}
+
+	return proxy.Upstream
+}
+
+// encryptRequest builds the encrypted tunnel request for req. decision
+// is the Dispatcher's resolved Decision for this destination (see
+// ProxyClient.dispatchDecision); callers are expected to have already
+// handled ActionReject/ActionDirect themselves, since by the time
+// encryptRequest runs the request is always going through the tunnel -
+// decision only still carries the additive Policy bits and RewriteTo
+// override (ActionSetPolicy/ActionRewriteHost/ActionMITM).
+func (proxy *ProxyClient) encryptRequest(req *http.Request, r *clientRequest, decision Decision) [ivLen]byte {
 	r.Auth = proxy.UserAuth
 	proxy.addToDummies(req)
 
+	upstream := proxy.upstream()
+
+	// ActionRewriteHost: send the request on to RewriteTo instead of the
+	// destination that matched the rule
+	if decision.RewriteTo != "" {
+		req.URL.Host = decision.RewriteTo
+	}
+
+	// the Dispatcher may add bits on top of the connection-wide policy for
+	// this particular destination, e.g. MITM ads but tunnel everything
+	// else through the same bridge server
+	policy := proxy.Policy
+	policy.Set(uint32(decision.Policy))
+
 	var urlBuf buffer
-	if proxy.Policy.IsSet(PolicyForward) {
+	if policy.IsSet(PolicyForward) {
 		r.Real = req.URL.String()
 		req.Header.Add(fwdURLHeader, urlBuf.Writes("http://", proxy.genHost(), "/", proxy.encryptClientRequest(r)).String())
-		req.Host = proxy.Upstream
-		req.URL, _ = urlBuf.R().Writes("http://", proxy.Upstream).ToURL()
+		req.Host = upstream
+		req.URL, _ = urlBuf.R().Writes("http://", upstream).ToURL()
 	} else {
 		req.Host = proxy.genHost()
 		r.Real = req.URL.String()
 		req.URL, _ = urlBuf.R().Writes("http://", req.Host, "/", proxy.encryptClientRequest(r)).ToURL()
 	}
 
-	if proxy.Policy.IsSet(PolicyMITM) && proxy.ProxyAuth != "" {
+	if policy.IsSet(PolicyMITM) && proxy.ProxyAuth != "" {
 		x := "Basic " + base64.StdEncoding.EncodeToString([]byte(proxy.ProxyAuth))
 		req.Header.Add("Proxy-Authorization", x)
 		req.Header.Add("Authorization", x)
@@ -208,7 +243,22 @@ func (proxy *ProxyServer) stripURI(uri string) string {
 	return uri
 }
 
-func (proxy *ProxyServer) decryptRequest(req *http.Request, r *clientRequest) {
+// decryptRequest decrypts the tunneled request in place and authenticates
+// it via authConn, which checks r.Auth (the clientRequest field carrying
+// whatever UserAuth/Authenticator credential the client embedded in
+// encryptRequest) or, when PolicyClientCert is set, the peer's verified
+// certificate in state instead. state is the TLS frontend's
+// ConnectionState for this connection and may be nil on a plaintext
+// listener; callers must stop processing the request on a false return
+// instead of relying on the previous decrypt-error-only early returns.
+func (proxy *ProxyServer) decryptRequest(req *http.Request, r *clientRequest, state *tls.ConnectionState) bool {
+	identity, ok := proxy.authConn(state, r.Auth)
+	if !ok {
+		proxy.Logger.Warnf("Authentication failed for %v", req)
+		return false
+	}
+	r.Identity = identity
+
 	var cookies buffer
 	var err error
 
@@ -216,7 +266,7 @@ func (proxy *ProxyServer) decryptRequest(req *http.Request, r *clientRequest) {
 		c.Value, err = proxy.Cipher.Decrypt(c.Value, r.IV)
 		if err != nil {
 			proxy.Logger.Errorf("Failed to decrypt cookie: %v, %v", err, req)
-			return
+			return false
 		}
 		cookies.Writes(c.String(), ";")
 	}
@@ -226,7 +276,7 @@ func (proxy *ProxyServer) decryptRequest(req *http.Request, r *clientRequest) {
 		origin, err = proxy.Decrypt(origin[:len(origin)-4], r.IV)
 		if err != nil {
 			proxy.Logger.Errorf("Failed to decrypt origin: %v, %v", err, req)
-			return
+			return false
 		}
 		req.Header.Set("Origin", origin)
 	}
@@ -235,7 +285,7 @@ func (proxy *ProxyServer) decryptRequest(req *http.Request, r *clientRequest) {
 		referer, err = proxy.Decrypt(referer, r.IV)
 		if err != nil {
 			proxy.Logger.Errorf("Failed to decrypt referer: %v, %v", err, req)
-			return
+			return false
 		}
 		req.Header.Set("Referer", referer)
 	}
@@ -252,10 +302,86 @@ func (proxy *ProxyServer) decryptRequest(req *http.Request, r *clientRequest) {
 		}
 	}
 
+	proxy.stripHopByHop(req.Header)
+
 	req.Body = proxy.Cipher.IO.NewReadCloser(req.Body, r.IV)
+	return true
+}
+
+// hopByHopHeaders is the RFC 7230 §6.1 set that must never be forwarded
+// by an intermediary.
+var hopByHopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"TE", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// isWebsocketUpgrade reports whether connectionHeader (the request's own
+// Connection field) carries an "upgrade" token per RFC 6455 §4.2.1,
+// matched case-insensitively against each comma-separated entry.
+func isWebsocketUpgrade(connectionHeader string) bool {
+	for _, tok := range strings.Split(connectionHeader, ",") {
+		if strings.EqualFold(strings.TrimSpace(tok), "upgrade") {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitizeHopByHop strips hop-by-hop headers from h per RFC 7230 §6.1:
+// the standard set, unless this is a WebSocket upgrade (in which case
+// Connection/Upgrade themselves must survive), plus every header named
+// in the request's own Connection field, plus the caller-supplied extra
+// allowlist (ProxyServer.HopByHopFilter). Call this on both the request
+// path (decryptRequest) and the response path, before copyHeaders writes
+// the result back to the peer, so neither direction leaks proxy-only
+// framing headers when goflyway is chained behind another reverse proxy.
+func sanitizeHopByHop(h http.Header, connectionHeader string, extra []string) {
+	isUpgrade := isWebsocketUpgrade(connectionHeader)
+
+	for _, name := range hopByHopHeaders {
+		if isUpgrade && (name == "Connection" || name == "Upgrade") {
+			continue
+		}
+		h.Del(name)
+	}
+
+	for _, tok := range strings.Split(connectionHeader, ",") {
+		name := strings.TrimSpace(tok)
+		if name == "" || (isUpgrade && strings.EqualFold(name, "upgrade")) {
+			continue
+		}
+		h.Del(name)
+	}
+
+	for _, name := range extra {
+		h.Del(name)
+	}
 }
 
-func copyHeaders(dst, src http.Header, gc *Cipher, enc bool, iv [ivLen]byte) {
+// stripHopByHop is the ProxyServer-bound convenience wrapper around
+// sanitizeHopByHop, pulling the Connection field off h itself and
+// applying the server's configured HopByHopFilter allowlist.
+func (proxy *ProxyServer) stripHopByHop(h http.Header) {
+	sanitizeHopByHop(h, h.Get("Connection"), proxy.HopByHopFilter)
+}
+
+// copyHeaders is the ProxyServer-bound wrapper callers on the response
+// path should use instead of the package-level copyHeaders, so the
+// operator-configured HopByHopFilter allowlist is honored there too and
+// not just in decryptRequest on the request path.
+func (proxy *ProxyServer) copyHeaders(dst, src http.Header, enc bool, iv [ivLen]byte) {
+	copyHeaders(dst, src, proxy.Cipher, enc, iv, proxy.HopByHopFilter)
+}
+
+// copyHeaders copies src into dst, applying cookie/content-type
+// encryption as directed by enc/iv. extraFilter is an additional
+// allowlist of header names to strip on top of the RFC 7230 hop-by-hop
+// set (see sanitizeHopByHop) - pass proxy.HopByHopFilter here, not nil,
+// so the operator-configured allowlist actually applies to whichever
+// header set is being copied, request or response.
+func copyHeaders(dst, src http.Header, gc *Cipher, enc bool, iv [ivLen]byte, extraFilter []string) {
+	sanitizeHopByHop(src, src.Get("Connection"), extraFilter)
+
 	for k := range dst {
 		dst.Del(k)
 	}
@@ -315,6 +441,13 @@ func copyHeaders(dst, src http.Header, gc *Cipher, enc bool, iv [ivLen]byte) {
 	}
 }
 
+// basicAuth validates a "Basic <base64>" Proxy-Authorization token
+// presented by a local client talking to this ProxyClient, returning the
+// decoded "user:pass" credential on success or "" on failure. It defers
+// to the configured Authenticator when set (so basicfile://-rotated
+// credentials gate the client side too, same as the server), and
+// otherwise falls back to a constant-time compare against the legacy
+// single UserAuth string.
 func (proxy *ProxyClient) basicAuth(token string) string {
 	parts := strings.Split(token, " ")
 	if len(parts) != 2 {
@@ -326,13 +459,38 @@ func (proxy *ProxyClient) basicAuth(token string) string {
 		return ""
 	}
 
-	if s := string(pa); s == proxy.UserAuth {
+	s := string(pa)
+
+	if proxy.Auth != nil {
+		user, pass, _ := strings.Cut(s, ":")
+		if proxy.Auth.Validate(user, pass) {
+			return s
+		}
+		return ""
+	}
+
+	if subtle.ConstantTimeCompare([]byte(s), []byte(proxy.UserAuth)) == 1 {
 		return s
 	}
 
 	return ""
 }
 
+// auth validates a "user:pass" pair (however it arrived - Proxy-Authorization
+// header or the decrypted clientRequest.Auth field) against the server's
+// configured Authenticator backend. Falls back to comparing against the
+// legacy single UserAuth string when no backend is configured, so old
+// single-secret configs keep working untouched.
+func (proxy *ProxyServer) auth(userpass string) bool {
+	user, pass, _ := strings.Cut(userpass, ":")
+
+	if proxy.Auth != nil {
+		return proxy.Auth.Validate(user, pass)
+	}
+
+	return subtle.ConstantTimeCompare([]byte(userpass), []byte(proxy.UserAuth)) == 1
+}
+
 func tryClose(b io.ReadCloser) {
 	if err := b.Close(); err != nil {
 		// proxy.Logger.Warnf("Can't close", err)